@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// BackendDirector rewrites an inbound proxy request so that it targets
+// the real object store, the same role httputil.ReverseProxy.Director
+// plays for a single backend. Each supported backend scheme provides
+// its own implementation. Direct returns an error when the request
+// can't be rewritten (e.g. a signing failure); the caller surfaces that
+// as a failed request rather than crashing the process.
+type BackendDirector interface {
+	Direct(r *http.Request) error
+}
+
+// directorErrorKey is the context key RoundDirector uses to smuggle a
+// Direct error past httputil.ReverseProxy.Director, which has no error
+// return of its own, to cachingTransport.RoundTrip.
+type directorErrorKey struct{}
+
+// RoundDirector adapts a BackendDirector into the plain
+// func(*http.Request) signature httputil.ReverseProxy.Director requires,
+// stashing any error in the request's context instead of dropping it.
+func RoundDirector(d BackendDirector) func(*http.Request) {
+	return func(r *http.Request) {
+		if err := d.Direct(r); err != nil {
+			*r = *r.WithContext(context.WithValue(r.Context(), directorErrorKey{}, err))
+		}
+	}
+}
+
+// directorFactory builds a BackendDirector for backendURL. It may also
+// return a non-nil http.RoundTripper when requests rewritten by the
+// Director need something other than the default HTTP transport to be
+// carried out (e.g. file:// backends, which never leave the process).
+type directorFactory func(backendURL *url.URL) (BackendDirector, http.RoundTripper, error)
+
+// directorFactories is the scheme -> constructor registry, analogous to
+// the per-scheme "driver" map Arvados keepstore uses for its volume
+// backends.
+var directorFactories = map[string]directorFactory{}
+
+func registerDirector(scheme string, factory directorFactory) {
+	directorFactories[scheme] = factory
+}
+
+// newBackendDirector looks up and invokes the factory registered for
+// backendURL's scheme.
+func newBackendDirector(backendURL *url.URL) (BackendDirector, http.RoundTripper, error) {
+	factory, ok := directorFactories[backendURL.Scheme]
+	if !ok {
+		return nil, nil, fmt.Errorf("no backend driver registered for scheme %q", backendURL.Scheme)
+	}
+	return factory(backendURL)
+}
+
+// schemeRoundTripper dispatches to a per-scheme http.RoundTripper,
+// falling back to Default for schemes with no special handling (e.g.
+// the https:// presigned URLs produced by the S3/GCS/Azure directors).
+type schemeRoundTripper struct {
+	Default  http.RoundTripper
+	ByScheme map[string]http.RoundTripper
+}
+
+func (t *schemeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rt, ok := t.ByScheme[req.URL.Scheme]; ok {
+		return rt.RoundTrip(req)
+	}
+	return t.Default.RoundTrip(req)
+}
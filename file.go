@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fileDirector rewrites requests to target a path under baseDir on the
+// local filesystem. The actual read/write happens in fileRoundTripper,
+// which is registered alongside the Director so the backend never
+// needs to go over the network.
+type fileDirector struct {
+	baseDir string
+}
+
+func (d *fileDirector) Direct(r *http.Request) error {
+	rel := strings.TrimPrefix(r.URL.Path, "/")
+	path := filepath.Join(d.baseDir, rel)
+
+	// filepath.Join cleans ".." segments out of the joined result, but a
+	// request path with enough of them (e.g. "/../../etc/passwd") can
+	// still resolve outside baseDir entirely. Reject anything that
+	// doesn't stay under it rather than trusting Join's cleanup.
+	if path != d.baseDir && !strings.HasPrefix(path, d.baseDir+string(filepath.Separator)) {
+		return fmt.Errorf("request path %q escapes the backend base directory", r.URL.Path)
+	}
+
+	r.URL = &url.URL{Scheme: "file", Path: path}
+	r.Host = ""
+	return nil
+}
+
+// fileRoundTripper serves GET and PUT requests whose URL was rewritten
+// by fileDirector directly off the local filesystem, playing the same
+// role http.DefaultTransport plays for the S3/GCS/Azure backends.
+type fileRoundTripper struct{}
+
+func (fileRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	path := r.URL.Path
+
+	switch r.Method {
+	case http.MethodGet:
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			return newStatusResponse(r, http.StatusNotFound), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Date": {time.Now().UTC().Format(http.TimeFormat)}},
+			ContentLength: info.Size(),
+			Body:          f,
+		}, nil
+
+	case http.MethodPut:
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if _, err := io.Copy(f, r.Body); err != nil {
+			return nil, err
+		}
+		return newStatusResponse(r, http.StatusOK), nil
+
+	default:
+		return newStatusResponse(r, http.StatusMethodNotAllowed), nil
+	}
+}
+
+func newStatusResponse(req *http.Request, statusCode int) *http.Response {
+	var braw bytes.Buffer
+	fmt.Fprintf(&braw, "HTTP/1.1 %d %s\r\n\r\n", statusCode, http.StatusText(statusCode))
+	resp, err := http.ReadResponse(bufio.NewReader(&braw), req)
+	if err != nil {
+		panic(err)
+	}
+	return resp
+}
+
+func newFileDirector(backendURL *url.URL) (BackendDirector, http.RoundTripper, error) {
+	return &fileDirector{baseDir: filepath.Clean(backendURL.Path)}, fileRoundTripper{}, nil
+}
+
+func init() {
+	registerDirector("file", newFileDirector)
+}
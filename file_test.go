@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileDirectorDirect(t *testing.T) {
+	baseDir := filepath.Clean("/var/cache/bazel-remote")
+	d := &fileDirector{baseDir: baseDir}
+
+	tests := []struct {
+		name     string
+		path     string
+		wantErr  bool
+		wantPath string
+	}{
+		{"plain cas path", "/cas/abc123", false, filepath.Join(baseDir, "cas/abc123")},
+		{"nested path", "/instance/cas/abc123", false, filepath.Join(baseDir, "instance/cas/abc123")},
+		{"root path", "/", false, baseDir},
+		{"single traversal segment", "/../etc/passwd", true, ""},
+		{"traversal deep enough to escape entirely", "/../../../../../../etc/passwd", true, ""},
+		{"traversal that stays under baseDir", "/cas/../cas/abc123", false, filepath.Join(baseDir, "cas/abc123")},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &http.Request{URL: &url.URL{Path: tc.path}}
+			err := d.Direct(r)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Direct(%q) = nil error, want an error", tc.path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Direct(%q) = %v, want no error", tc.path, err)
+			}
+			if r.URL.Path != tc.wantPath {
+				t.Errorf("Direct(%q) rewrote path to %q, want %q", tc.path, r.URL.Path, tc.wantPath)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "strings"
+
+// casPathDigest extracts the expected sha256 hex digest of a Bazel
+// remote cache content-addressable-storage (CAS) blob from its request
+// path, e.g. "/cas/<sha256>" or "/<instance>/cas/<sha256>". ok is false
+// for action-cache ("ac/") paths or anything else that doesn't look
+// like a CAS entry, in which case digest verification is skipped.
+func casPathDigest(path string) (digest string, ok bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for i, part := range parts {
+		if part == "cas" && i+1 < len(parts) && isHexSHA256(parts[i+1]) {
+			return parts[i+1], true
+		}
+	}
+	return "", false
+}
+
+const sha256HexLen = 64
+
+func isHexSHA256(s string) bool {
+	if len(s) != sha256HexLen {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+const validDigest = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func TestCasPathDigest(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		wantDigest string
+		wantOK     bool
+	}{
+		{"bare cas path", "/cas/" + validDigest, validDigest, true},
+		{"cas path with instance name", "/my-instance/cas/" + validDigest, validDigest, true},
+		{"action cache path is not CAS", "/ac/" + validDigest, "", false},
+		{"digest too short", "/cas/deadbeef", "", false},
+		{"non-hex digest", "/cas/" + "g" + validDigest[1:], "", false},
+		{"trailing slash", "/cas/" + validDigest + "/", validDigest, true},
+		{"no cas segment", "/" + validDigest, "", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			digest, ok := casPathDigest(tc.path)
+			if ok != tc.wantOK || digest != tc.wantDigest {
+				t.Errorf("casPathDigest(%q) = (%q, %v), want (%q, %v)", tc.path, digest, ok, tc.wantDigest, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestIsHexSHA256(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want bool
+	}{
+		{"valid lowercase hex", validDigest, true},
+		{"too short", validDigest[:63], false},
+		{"too long", validDigest + "a", false},
+		{"uppercase hex rejected", "A" + validDigest[1:], false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isHexSHA256(tc.s); got != tc.want {
+				t.Errorf("isHexSHA256(%q) = %v, want %v", tc.s, got, tc.want)
+			}
+		})
+	}
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
@@ -16,48 +19,97 @@ import (
 	"time"
 
 	"github.com/PuerkitoBio/rehttp"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/gregjones/httpcache"
 	"github.com/gregjones/httpcache/diskcache"
 	"github.com/peterbourgon/diskv"
 )
 
 var (
-	bind              = flag.String("bind", "127.0.0.1:7643", "address and port to bind to")
-	backend           = flag.String("backend", "", "uri of backend storage service, e.g. s3://my-bazel-cache/prefix")
-	cacheDir          = flag.String("cache-dir", "", "local cache directory")
-	cacheSize         = flag.Uint64("cache-size", 5, "local cache size in gigabytes")
-	cacheRefreshDelay = flag.Int64("cache-refresh-delay", 60, "the delay in minutes after which missed requests will be retried in the next cache tier")
-	allowWrites       = flag.Bool("allow-writes", false, "allow PUT requests to the cache")
-	maxRetries        = flag.Int("max-retries", 1, "maximum number of retries when hitting the next cache tier")
+	bind               = flag.String("bind", "127.0.0.1:7643", "address and port to bind to")
+	backend            = flag.String("backend", "", "uri of backend storage service, e.g. s3://my-bazel-cache/prefix")
+	cacheDir           = flag.String("cache-dir", "", "local cache directory")
+	cacheSize          = flag.Uint64("cache-size", 5, "local cache size in gigabytes")
+	cacheRefreshDelay  = flag.Int64("cache-refresh-delay", 60, "the delay in minutes after which missed requests will be retried in the next cache tier")
+	allowWrites        = flag.Bool("allow-writes", false, "allow PUT requests to the cache")
+	maxRetries         = flag.Int("max-retries", 1, "maximum number of retries when hitting the next cache tier")
+	metricsBind        = flag.String("metrics-bind", "", "address and port to serve prometheus /metrics on (disabled if empty)")
+	uploadConcurrency  = flag.Int("upload-concurrency", 4, "number of chunks to upload or download in parallel for multipart transfers")
+	uploadChunkSize    = flag.Int64("upload-chunk-size", 32*1024*1024, "chunk size in bytes used for multipart uploads and chunked downloads")
+	multipartThreshold = flag.Int64("multipart-threshold", 100*1024*1024, "responses and uploads larger than this many bytes use chunked transfer and spill-to-disk buffering")
+
+	s3Endpoint     = flag.String("s3-endpoint", "", "non-AWS S3-compatible endpoint to use instead of the default AWS endpoints, e.g. for MinIO or GCS's S3 interoperability gateway")
+	s3Region       = flag.String("s3-region", "", "AWS region to use, overriding the SDK's default resolution")
+	s3StorageClass = flag.String("s3-storage-class", "", "S3 storage class to write objects with, e.g. STANDARD_IA, INTELLIGENT_TIERING, ONEZONE_IA (default: bucket default)")
+	s3SSE          = flag.String("s3-sse", "", "server-side encryption to request for uploaded objects: AES256 or aws:kms (default: none)")
+	s3SSEKMSKeyID  = flag.String("s3-sse-kms-key-id", "", "KMS key id to use when -s3-sse=aws:kms (default: the account's default CMK)")
 )
 
 type cachingTransport struct {
 	Transport http.RoundTripper
 	Cache     httpcache.Cache
+
+	// Multipart holds the S3 client and chunking parameters used to
+	// prewarm the local cache with parallel ranged GETs on a cache miss
+	// for large objects. It is nil when the backend isn't S3.
+	Multipart *multipartConfig
 }
 
 // cachingReadCloser is a wrapper around ReadCloser R that calls OnEOF
 // handler with a full copy of the content read from R when EOF is
-// reached.
+// reached. The copy is accumulated in a Blob, which spills to a temp
+// file once it grows past -multipart-threshold so that caching a large
+// CAS blob doesn't require holding the whole thing in memory.
+//
+// If ExpectedDigest is set, the content is hashed as it streams
+// through, and OnEOF is skipped (the response is not cached) when the
+// digest doesn't match, since that means an upstream cache tier served
+// a corrupted CAS entry.
 type cachingReadCloser struct {
 	// Underlying ReadCloser.
 	R io.ReadCloser
 	// OnEOF is called with a copy of the content of R when EOF is reached.
 	OnEOF func(io.Reader)
+	// ExpectedDigest is the sha256 hex digest a CAS request path claims
+	// for this content, or "" if the path isn't a CAS entry.
+	ExpectedDigest string
+	// CacheKey identifies the request, for the INTEGRITY_ERROR log line.
+	CacheKey string
 
-	buf bytes.Buffer // buf stores a copy of the content of R.
+	blob   *spillBlob // blob stores a copy of the content of R.
+	hasher hash.Hash
 }
 
 // Read reads the next len(p) bytes from R or until R is drained. The
 // return value n is the number of bytes read. If R has no data to
 // return, err is io.EOF and OnEOF is called with a full copy of what
-// has been read so far.
+// has been read so far, unless ExpectedDigest is set and doesn't match.
 func (r *cachingReadCloser) Read(p []byte) (n int, err error) {
+	if r.blob == nil {
+		r.blob = newSpillBlob(*multipartThreshold)
+		if r.ExpectedDigest != "" {
+			r.hasher = sha256.New()
+		}
+	}
 	n, err = r.R.Read(p)
-	r.buf.Write(p[:n])
+	if n > 0 {
+		if _, werr := r.blob.Write(p[:n]); werr != nil {
+			return n, werr
+		}
+		if r.hasher != nil {
+			r.hasher.Write(p[:n])
+		}
+	}
 	if err == io.EOF {
-		r.OnEOF(bytes.NewReader(r.buf.Bytes()))
+		defer r.blob.Close()
+		if r.hasher != nil {
+			got := hex.EncodeToString(r.hasher.Sum(nil))
+			if got != r.ExpectedDigest {
+				log.Printf("INTEGRITY_ERROR %s: expected digest %s, got %s", r.CacheKey, r.ExpectedDigest, got)
+				requestsTotal.WithLabelValues("INTEGRITY_ERROR", http.MethodGet, "").Inc()
+				return n, err
+			}
+		}
+		r.OnEOF(io.NewSectionReader(r.blob, 0, r.blob.Size()))
 	}
 	return n, err
 }
@@ -86,6 +138,36 @@ func newDroppedResponse(req *http.Request) *http.Response {
 	return resp
 }
 
+func newOKResponse(req *http.Request) *http.Response {
+	var braw bytes.Buffer
+	braw.WriteString("HTTP/1.1 200 OK\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(&braw), req)
+	if err != nil {
+		panic(err)
+	}
+	return resp
+}
+
+// uploadMarkerKey returns the cache key used to record that a PUT for
+// cacheKey has already completed. It's deliberately namespaced away
+// from cacheKey itself: cacheKey is where a real, servable GET response
+// is stored, and a bare "upload happened" marker is not one - serving
+// it back to a GET would hand the client an empty body instead of the
+// blob it asked for.
+func uploadMarkerKey(cacheKey string) string {
+	return "put\x00" + cacheKey
+}
+
+// markDigestCached records that a PUT for cacheKey has completed, so
+// that a later upload of the same CAS digest is recognized as
+// redundant. It's used both after a successful PUT completes and after
+// a successful multipart PUT, since neither goes through the GET
+// caching path that normally populates cache. It does not seed cacheKey
+// itself, since we never read the uploaded body back to verify it.
+func markDigestCached(cache httpcache.Cache, cacheKey string) {
+	cache.Set(uploadMarkerKey(cacheKey), []byte{1})
+}
+
 func (t *cachingTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
 	cacheKey := req.URL.Path
 	var logAction string
@@ -99,8 +181,13 @@ func (t *cachingTransport) RoundTrip(req *http.Request) (resp *http.Response, er
 			status = fmt.Sprintf("%d", resp.StatusCode)
 		}
 		log.Printf("%-15s %3s %15s %4s %s", logAction, status, req.URL.Host, req.Method, req.URL.Path)
+		requestsTotal.WithLabelValues(logAction, req.Method, status).Inc()
 	}()
 
+	if directorErr, ok := req.Context().Value(directorErrorKey{}).(error); ok {
+		return nil, directorErr
+	}
+
 	doCache := req.Method == http.MethodGet && t.Cache != nil
 
 	if doCache {
@@ -125,8 +212,31 @@ func (t *cachingTransport) RoundTrip(req *http.Request) (resp *http.Response, er
 			t.Cache.Delete(cacheKey)
 		} else {
 			logAction = "CACHE_MISS"
+			if t.Multipart != nil {
+				var prewarmed bool
+				resp, prewarmed, err = t.Multipart.prewarm(req, t.Cache, cacheKey)
+				if err != nil {
+					return
+				}
+				if prewarmed {
+					logAction = "CACHE_MISS"
+					return
+				}
+			}
 		}
-	} else if (req.Method == http.MethodPut && *allowWrites) || req.Method == http.MethodGet {
+	} else if req.Method == http.MethodPut && *allowWrites {
+		// The path of a CAS entry *is* its digest, so a marker recording
+		// that we've already uploaded this exact path proves this upload
+		// would be redundant.
+		if _, isCAS := casPathDigest(cacheKey); isCAS && t.Cache != nil {
+			if _, hit := t.Cache.Get(uploadMarkerKey(cacheKey)); hit {
+				logAction = "CACHE_HIT"
+				resp = newOKResponse(req)
+				return
+			}
+		}
+		logAction = "PASSTHROUGH"
+	} else if req.Method == http.MethodGet {
 		logAction = "PASSTHROUGH"
 	} else {
 		logAction = "DROP"
@@ -134,12 +244,22 @@ func (t *cachingTransport) RoundTrip(req *http.Request) (resp *http.Response, er
 		return
 	}
 
+	backendStart := time.Now()
 	resp, err = t.Transport.RoundTrip(req)
+	if err == nil {
+		backendLatencySeconds.WithLabelValues(req.Method).Observe(time.Since(backendStart).Seconds())
+		if resp.ContentLength >= 0 {
+			backendResponseBytes.WithLabelValues(req.Method).Observe(float64(resp.ContentLength))
+		}
+	}
 
 	if err == nil && doCache {
+		expectedDigest, _ := casPathDigest(cacheKey)
 		// Delay caching until EOF is reached.
 		resp.Body = &cachingReadCloser{
-			R: resp.Body,
+			R:              resp.Body,
+			ExpectedDigest: expectedDigest,
+			CacheKey:       cacheKey,
 			OnEOF: func(r io.Reader) {
 				resp := *resp
 				resp.Body = ioutil.NopCloser(r)
@@ -150,6 +270,12 @@ func (t *cachingTransport) RoundTrip(req *http.Request) (resp *http.Response, er
 			},
 		}
 	}
+
+	if err == nil && req.Method == http.MethodPut && t.Cache != nil && resp.StatusCode/100 == 2 {
+		if _, isCAS := casPathDigest(cacheKey); isCAS {
+			markDigestCached(t.Cache, cacheKey)
+		}
+	}
 	return
 }
 
@@ -167,24 +293,47 @@ func main() {
 	}
 
 	var handler *httputil.ReverseProxy
-	switch backendURL.Scheme {
-	case "s3":
-		d := newS3Director(session.New(), backendURL)
-		handler = &httputil.ReverseProxy{
-			Director: d.Direct,
+	var multipart *multipartConfig
+	var backendRoundTripper http.RoundTripper
+
+	if _, registered := directorFactories[backendURL.Scheme]; registered {
+		d, rt, err := newBackendDirector(backendURL)
+		if err != nil {
+			log.Fatalf("failed to set up %s:// backend: %v", backendURL.Scheme, err)
 		}
-	default:
+		handler = &httputil.ReverseProxy{Director: RoundDirector(d)}
+		backendRoundTripper = rt
+
+		// Chunked multipart transfer is currently only implemented for
+		// the S3 backend.
+		if sd, ok := d.(*s3Director); ok {
+			multipart = &multipartConfig{
+				s3Svc:       sd.s3Svc,
+				bucket:      sd.bucket,
+				prefix:      sd.prefix,
+				threshold:   *multipartThreshold,
+				chunkSize:   *uploadChunkSize,
+				concurrency: *uploadConcurrency,
+				objOpts:     sd.objOpts,
+			}
+		}
+	} else {
 		handler = httputil.NewSingleHostReverseProxy(backendURL)
 	}
 
-	baseTransport := http.DefaultTransport
+	var baseTransport http.RoundTripper = newBaseTransport(*connectTimeout, *readTimeout)
 	if *maxRetries > 1 {
 		baseTransport = rehttp.NewTransport(
 			baseTransport,
-			rehttp.RetryMaxRetries(*maxRetries), // Retry for ALL types of errors!
-			rehttp.ExpJitterDelay(500*time.Millisecond, 10*time.Second),
+			retryPolicy(*maxRetries, parseRetryStatusCodes(*retryStatusCodes)),
+			retryDelay(rehttp.ExpJitterDelay(500*time.Millisecond, 10*time.Second)),
 		)
-
+	}
+	if backendRoundTripper != nil {
+		baseTransport = &schemeRoundTripper{
+			Default:  baseTransport,
+			ByScheme: map[string]http.RoundTripper{backendURL.Scheme: backendRoundTripper},
+		}
 	}
 	var cache httpcache.Cache
 	if *cacheDir != "" {
@@ -193,11 +342,25 @@ func main() {
 			CacheSizeMax: *cacheSize * 1024 * 1024 * 1024,
 		})
 		cache = diskcache.NewWithDiskv(diskKeyValueStore)
+		go watchLocalCacheSize(*cacheDir, 30*time.Second)
+	}
+	if multipart != nil {
+		multipart.cache = cache
+	}
+
+	if *metricsBind != "" {
+		go serveMetrics(*metricsBind)
 	}
 
 	handler.Transport = &cachingTransport{
 		Cache:     cache,
-		Transport: http.DefaultTransport,
+		Transport: baseTransport,
+		Multipart: multipart,
+	}
+
+	var rootHandler http.Handler = handler
+	if multipart != nil && *allowWrites {
+		rootHandler = &multipartPutHandler{next: handler, config: multipart}
 	}
 
 	addr := *bind
@@ -206,7 +369,7 @@ func main() {
 	}
 	s := &http.Server{
 		Addr:    addr,
-		Handler: handler,
+		Handler: rootHandler,
 	}
 	log.Printf("Listening on %s", addr)
 	log.Fatal(s.ListenAndServe())
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bazel_remote_cache_requests_total",
+		Help: "Total number of requests handled by the caching transport, by action, method and status.",
+	}, []string{"action", "method", "status"})
+
+	backendLatencySeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bazel_remote_cache_backend_request_duration_seconds",
+		Help:    "Latency of requests forwarded to the next cache tier.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+
+	backendResponseBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bazel_remote_cache_backend_response_bytes",
+		Help:    "Size in bytes of responses received from the next cache tier.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+	}, []string{"method"})
+
+	localCacheSizeBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "bazel_remote_cache_local_disk_bytes",
+		Help: "Total size in bytes of the local diskv cache directory.",
+	})
+
+	backendOperationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bazel_remote_cache_backend_operations_total",
+		Help: "Total number of object-store backend operations, by backend, op and result.",
+	}, []string{"backend", "op", "result"})
+)
+
+// serveMetrics starts a dedicated HTTP server exposing the prometheus
+// handler on addr. It is expected to be run in its own goroutine.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Printf("Serving metrics on %s", addr)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
+
+// watchLocalCacheSize periodically walks dir and updates
+// localCacheSizeBytes with the total size of the files found there.
+func watchLocalCacheSize(dir string, interval time.Duration) {
+	for {
+		var size int64
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				size += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Failed to compute local cache size: %v", err)
+		} else {
+			localCacheSizeBytes.Set(float64(size))
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gregjones/httpcache"
+	"golang.org/x/sync/errgroup"
+)
+
+// Blob is a randomly-readable chunk of data of known size, backed by
+// either memory or disk. It models the same shape as the blob
+// abstraction used by the GitHub Actions cache client, so that chunked
+// upload and download code doesn't care where the bytes actually live.
+type Blob interface {
+	io.ReaderAt
+	Size() int64
+	io.Closer
+}
+
+// spillBlob accumulates written bytes in memory up to threshold bytes,
+// then spills the rest to a temp file. It is used in place of a plain
+// bytes.Buffer so that caching a multi-hundred-megabyte CAS blob
+// doesn't require holding the whole thing in memory at once.
+type spillBlob struct {
+	threshold int64
+
+	mu   sync.Mutex
+	mem  []byte
+	file *os.File
+	size int64
+}
+
+func newSpillBlob(threshold int64) *spillBlob {
+	return &spillBlob{threshold: threshold}
+}
+
+// spillToFile moves any in-memory content to a backing temp file, if it
+// hasn't already been created. Callers must hold b.mu.
+func (b *spillBlob) spillToFile() error {
+	if b.file != nil {
+		return nil
+	}
+	f, err := ioutil.TempFile("", "bazel-remote-cache-spill-")
+	if err != nil {
+		return fmt.Errorf("creating spill file: %w", err)
+	}
+	if len(b.mem) > 0 {
+		if _, err := f.Write(b.mem); err != nil {
+			return err
+		}
+	}
+	b.file = f
+	b.mem = nil
+	return nil
+}
+
+func (b *spillBlob) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.file == nil && b.size+int64(len(p)) > b.threshold {
+		if err := b.spillToFile(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := len(p)
+	if b.file != nil {
+		if _, err := b.file.Write(p); err != nil {
+			return 0, err
+		}
+	} else {
+		b.mem = append(b.mem, p...)
+	}
+	b.size += int64(n)
+	return n, nil
+}
+
+// WriteAt writes p at offset off, spilling to a temp file on first use
+// since concurrent writers can't safely share a growable in-memory
+// buffer. It is used by downloadChunked, where the final size is known
+// upfront and always exceeds threshold.
+func (b *spillBlob) WriteAt(p []byte, off int64) (int, error) {
+	b.mu.Lock()
+	if err := b.spillToFile(); err != nil {
+		b.mu.Unlock()
+		return 0, err
+	}
+	if end := off + int64(len(p)); end > b.size {
+		b.size = end
+	}
+	b.mu.Unlock()
+
+	return b.file.WriteAt(p, off)
+}
+
+func (b *spillBlob) ReadAt(p []byte, off int64) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.file != nil {
+		return b.file.ReadAt(p, off)
+	}
+	if off >= int64(len(b.mem)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b.mem[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (b *spillBlob) Size() int64 {
+	return b.size
+}
+
+func (b *spillBlob) Close() error {
+	if b.file != nil {
+		name := b.file.Name()
+		err := b.file.Close()
+		os.Remove(name)
+		return err
+	}
+	return nil
+}
+
+// chunkCount returns the number of chunkSize-sized chunks needed to
+// cover size bytes, i.e. ceil(size/chunkSize).
+func chunkCount(size, chunkSize int64) int {
+	return int((size + chunkSize - 1) / chunkSize)
+}
+
+// s3MultipartUploader drives a multipart upload of a Blob to S3,
+// pushing chunkSize chunks in parallel up to concurrency at a time.
+type s3MultipartUploader struct {
+	s3Svc       *s3.S3
+	bucket      string
+	key         string
+	chunkSize   int64
+	concurrency int
+	objOpts     s3ObjectOptions
+}
+
+func (u *s3MultipartUploader) Upload(ctx context.Context, blob Blob) error {
+	createInput := &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(u.bucket),
+		Key:    aws.String(u.key),
+	}
+	if u.objOpts.StorageClass != "" {
+		createInput.StorageClass = aws.String(u.objOpts.StorageClass)
+	}
+	if u.objOpts.ServerSideEncryption != "" {
+		createInput.ServerSideEncryption = aws.String(u.objOpts.ServerSideEncryption)
+	}
+	if u.objOpts.SSEKMSKeyID != "" {
+		createInput.SSEKMSKeyId = aws.String(u.objOpts.SSEKMSKeyID)
+	}
+
+	created, err := u.s3Svc.CreateMultipartUploadWithContext(ctx, createInput)
+	if err != nil {
+		return fmt.Errorf("creating multipart upload: %w", err)
+	}
+	uploadID := created.UploadId
+
+	size := blob.Size()
+	numParts := chunkCount(size, u.chunkSize)
+	if numParts == 0 {
+		numParts = 1
+	}
+
+	parts := make([]*s3.CompletedPart, numParts)
+	group, groupCtx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, u.concurrency)
+
+	for i := 0; i < numParts; i++ {
+		i := i
+		sem <- struct{}{}
+		group.Go(func() error {
+			defer func() { <-sem }()
+
+			off := int64(i) * u.chunkSize
+			n := u.chunkSize
+			if remaining := size - off; remaining < n {
+				n = remaining
+			}
+			buf := make([]byte, n)
+			if _, err := blob.ReadAt(buf, off); err != nil && err != io.EOF {
+				return fmt.Errorf("reading chunk %d: %w", i, err)
+			}
+
+			partNumber := int64(i + 1)
+			result, err := u.s3Svc.UploadPartWithContext(groupCtx, &s3.UploadPartInput{
+				Bucket:     aws.String(u.bucket),
+				Key:        aws.String(u.key),
+				UploadId:   uploadID,
+				PartNumber: aws.Int64(partNumber),
+				Body:       bytes.NewReader(buf),
+			})
+			if err != nil {
+				return fmt.Errorf("uploading part %d: %w", partNumber, err)
+			}
+			parts[i] = &s3.CompletedPart{
+				ETag:       result.ETag,
+				PartNumber: aws.Int64(partNumber),
+			}
+			return nil
+		})
+	}
+
+	if err := group.Wait(); err != nil {
+		u.s3Svc.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(u.bucket),
+			Key:      aws.String(u.key),
+			UploadId: uploadID,
+		})
+		return err
+	}
+
+	_, err = u.s3Svc.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(u.bucket),
+		Key:             aws.String(u.key),
+		UploadId:        uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return fmt.Errorf("completing multipart upload: %w", err)
+	}
+	return nil
+}
+
+// downloadChunked prewarms dst with the contents of bucket/key by
+// issuing parallel ranged GETs of chunkSize bytes each, up to
+// concurrency at a time.
+func downloadChunked(ctx context.Context, s3Svc *s3.S3, bucket, key string, size, chunkSize int64, concurrency int, dst io.WriterAt) error {
+	numChunks := chunkCount(size, chunkSize)
+	if numChunks == 0 {
+		return nil
+	}
+
+	group, groupCtx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, concurrency)
+
+	for i := 0; i < numChunks; i++ {
+		i := i
+		sem <- struct{}{}
+		group.Go(func() error {
+			defer func() { <-sem }()
+
+			off := int64(i) * chunkSize
+			last := off + chunkSize - 1
+			if last >= size {
+				last = size - 1
+			}
+			rng := fmt.Sprintf("bytes=%d-%d", off, last)
+
+			out, err := s3Svc.GetObjectWithContext(groupCtx, &s3.GetObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(key),
+				Range:  aws.String(rng),
+			})
+			if err != nil {
+				return fmt.Errorf("getting range %s: %w", rng, err)
+			}
+			defer out.Body.Close()
+
+			buf, err := ioutil.ReadAll(out.Body)
+			if err != nil {
+				return fmt.Errorf("reading range %s: %w", rng, err)
+			}
+			if _, err := dst.WriteAt(buf, off); err != nil {
+				return fmt.Errorf("writing range %s: %w", rng, err)
+			}
+			return nil
+		})
+	}
+
+	return group.Wait()
+}
+
+// multipartConfig holds the S3 client and chunking parameters needed to
+// prewarm the local disk cache on a miss, and to accept large PUTs as a
+// multipart upload instead of a single presigned PUT.
+type multipartConfig struct {
+	s3Svc       *s3.S3
+	bucket      string
+	prefix      string
+	threshold   int64
+	chunkSize   int64
+	concurrency int
+	objOpts     s3ObjectOptions
+	cache       httpcache.Cache
+}
+
+// blobReadCloser adapts a Blob into an io.ReadCloser, releasing any
+// backing temp file on Close.
+type blobReadCloser struct {
+	*io.SectionReader
+	blob Blob
+}
+
+func (b *blobReadCloser) Close() error {
+	return b.blob.Close()
+}
+
+// prewarm checks whether req names an object larger than m.threshold
+// and, if so, fetches it with parallel ranged GETs, seeds cache with
+// the result and returns a response body serving it. ok is false (with
+// a nil resp and error) when the object is small enough that the
+// caller should fall back to the normal single-request fetch path.
+func (m *multipartConfig) prewarm(req *http.Request, cache httpcache.Cache, cacheKey string) (resp *http.Response, ok bool, err error) {
+	key := effectiveKey(m.prefix, req.URL.Path)
+
+	head, err := m.s3Svc.HeadObjectWithContext(req.Context(), &s3.HeadObjectInput{
+		Bucket: aws.String(m.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		// No such object (or a transient error): let the normal fetch
+		// path run and surface the failure the usual way.
+		return nil, false, nil
+	}
+
+	size := aws.Int64Value(head.ContentLength)
+	if size <= m.threshold {
+		return nil, false, nil
+	}
+
+	blob := newSpillBlob(m.threshold)
+	if err := downloadChunked(req.Context(), m.s3Svc, m.bucket, key, size, m.chunkSize, m.concurrency, blob); err != nil {
+		blob.Close()
+		return nil, false, err
+	}
+
+	if expectedDigest, isCAS := casPathDigest(req.URL.Path); isCAS {
+		hasher := sha256.New()
+		if _, err := io.Copy(hasher, io.NewSectionReader(blob, 0, blob.Size())); err != nil {
+			blob.Close()
+			return nil, false, err
+		}
+		if got := hex.EncodeToString(hasher.Sum(nil)); got != expectedDigest {
+			blob.Close()
+			log.Printf("INTEGRITY_ERROR %s: expected digest %s, got %s", cacheKey, expectedDigest, got)
+			requestsTotal.WithLabelValues("INTEGRITY_ERROR", req.Method, "").Inc()
+			return nil, false, fmt.Errorf("integrity check failed for %s: expected digest %s, got %s", key, expectedDigest, got)
+		}
+	}
+
+	resp = &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Date": {time.Now().UTC().Format(http.TimeFormat)}},
+		ContentLength: size,
+	}
+
+	// DumpResponse drains and closes resp.Body, and blobReadCloser.Close
+	// removes the backing spill file, so dump a plain NopCloser reader
+	// over the blob rather than handing it the Body we're about to
+	// serve to the real client.
+	dumpResp := *resp
+	dumpResp.Body = ioutil.NopCloser(io.NewSectionReader(blob, 0, blob.Size()))
+	respBytes, dumpErr := httputil.DumpResponse(&dumpResp, true)
+	if dumpErr == nil {
+		cache.Set(cacheKey, respBytes)
+	}
+
+	resp.Body = &blobReadCloser{
+		SectionReader: io.NewSectionReader(blob, 0, blob.Size()),
+		blob:          blob,
+	}
+
+	return resp, true, nil
+}
+
+// multipartPutHandler intercepts PUTs larger than threshold and pushes
+// them to S3 as a multipart upload instead of relying on the reverse
+// proxy's single presigned PUT.
+type multipartPutHandler struct {
+	next   http.Handler
+	config *multipartConfig
+}
+
+func (h *multipartPutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut || r.ContentLength <= h.config.threshold {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	cacheKey := r.URL.Path
+	if _, isCAS := casPathDigest(cacheKey); isCAS && h.config.cache != nil {
+		if _, hit := h.config.cache.Get(uploadMarkerKey(cacheKey)); hit {
+			backendOperationsTotal.WithLabelValues("s3", "MULTIPART_PUT", "skipped").Inc()
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+
+	key := effectiveKey(h.config.prefix, r.URL.Path)
+	blob := newSpillBlob(h.config.threshold)
+	defer blob.Close()
+
+	if _, err := io.Copy(blob, r.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	if expectedDigest, isCAS := casPathDigest(cacheKey); isCAS {
+		hasher := sha256.New()
+		if _, err := io.Copy(hasher, io.NewSectionReader(blob, 0, blob.Size())); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if got := hex.EncodeToString(hasher.Sum(nil)); got != expectedDigest {
+			log.Printf("INTEGRITY_ERROR %s: expected digest %s, got %s", cacheKey, expectedDigest, got)
+			requestsTotal.WithLabelValues("INTEGRITY_ERROR", http.MethodPut, "").Inc()
+			http.Error(w, fmt.Sprintf("digest mismatch: expected %s, got %s", expectedDigest, got), http.StatusBadRequest)
+			return
+		}
+	}
+
+	uploader := &s3MultipartUploader{
+		s3Svc:       h.config.s3Svc,
+		bucket:      h.config.bucket,
+		key:         key,
+		chunkSize:   h.config.chunkSize,
+		concurrency: h.config.concurrency,
+		objOpts:     h.config.objOpts,
+	}
+	if err := uploader.Upload(r.Context(), blob); err != nil {
+		log.Printf("multipart upload of %s failed: %v", key, err)
+		backendOperationsTotal.WithLabelValues("s3", "MULTIPART_PUT", "error").Inc()
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	if h.config.cache != nil {
+		if _, isCAS := casPathDigest(cacheKey); isCAS {
+			markDigestCached(h.config.cache, cacheKey)
+		}
+	}
+
+	backendOperationsTotal.WithLabelValues("s3", "MULTIPART_PUT", "ok").Inc()
+	w.WriteHeader(http.StatusOK)
+}
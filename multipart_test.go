@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestChunkCount(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int64
+		chunkSize int64
+		want      int
+	}{
+		{"zero size", 0, 32, 0},
+		{"exact multiple", 64, 32, 2},
+		{"one byte over a multiple", 65, 32, 3},
+		{"one byte under a multiple", 63, 32, 2},
+		{"smaller than chunk size", 10, 32, 1},
+		{"single chunk covers everything", 32, 32, 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := chunkCount(tc.size, tc.chunkSize); got != tc.want {
+				t.Errorf("chunkCount(%d, %d) = %d, want %d", tc.size, tc.chunkSize, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/rehttp"
+)
+
+var (
+	connectTimeout = flag.Duration("connect-timeout", time.Minute, "timeout for establishing a connection to the next cache tier")
+	readTimeout    = flag.Duration("read-timeout", 10*time.Minute, "timeout for completing a request to the next cache tier, including reading the response body")
+
+	retryStatusCodes = flag.String("retry-status-codes", "429,500,502,503,504", "comma-separated list of HTTP status codes from the next cache tier that are safe to retry")
+)
+
+// idempotentMethods are the only methods rehttp is allowed to retry.
+// Retrying a PUT blindly (the previous behavior) risks double-applying
+// a write whose first attempt actually succeeded upstream.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+}
+
+func parseRetryStatusCodes(s string) map[int]bool {
+	codes := map[int]bool{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if code, err := strconv.Atoi(part); err == nil {
+			codes[code] = true
+		}
+	}
+	return codes
+}
+
+// retryPolicy retries up to maxRetries times, and only for idempotent
+// requests that either failed outright or got back one of codes.
+func retryPolicy(maxRetries int, codes map[int]bool) rehttp.RetryFn {
+	return func(attempt rehttp.Attempt) bool {
+		if attempt.Index >= maxRetries {
+			return false
+		}
+		if !idempotentMethods[attempt.Request.Method] {
+			return false
+		}
+		if attempt.Response == nil {
+			return attempt.Error != nil
+		}
+		return codes[attempt.Response.StatusCode]
+	}
+}
+
+// retryDelay honors a Retry-After response header when present, falling
+// back to base otherwise.
+func retryDelay(base rehttp.DelayFn) rehttp.DelayFn {
+	return func(attempt rehttp.Attempt) time.Duration {
+		if attempt.Response != nil {
+			if ra := attempt.Response.Header.Get("Retry-After"); ra != "" {
+				if secs, err := strconv.Atoi(ra); err == nil {
+					return time.Duration(secs) * time.Second
+				}
+				if at, err := http.ParseTime(ra); err == nil {
+					if d := time.Until(at); d > 0 {
+						return d
+					}
+				}
+			}
+		}
+		return base(attempt)
+	}
+}
+
+// newBaseTransport builds the http.RoundTripper used to talk to the next
+// cache tier: a clone of http.DefaultTransport (keeping its proxy and TLS
+// handshake settings) with the configured connect timeout, wrapped so
+// that the *entire* request (including reading the response body) is
+// bounded by readTimeout.
+func newBaseTransport(connectTimeout, readTimeout time.Duration) http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout: connectTimeout,
+	}).DialContext
+	return &readTimeoutTransport{Transport: transport, ReadTimeout: readTimeout}
+}
+
+type readTimeoutTransport struct {
+	Transport   http.RoundTripper
+	ReadTimeout time.Duration
+}
+
+func (t *readTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.ReadTimeout)
+	resp, err := t.Transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnCloseBody releases the read-timeout context once the caller
+// is done with the response body, rather than waiting for the timeout
+// to fire on a long-idle-but-otherwise-fine connection.
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
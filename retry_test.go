@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/PuerkitoBio/rehttp"
+)
+
+func TestParseRetryStatusCodes(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want map[int]bool
+	}{
+		{"default list", "429,500,502,503,504", map[int]bool{429: true, 500: true, 502: true, 503: true, 504: true}},
+		{"whitespace and empty entries are ignored", " 500 ,,503", map[int]bool{500: true, 503: true}},
+		{"non-numeric entries are ignored", "500,not-a-code,503", map[int]bool{500: true, 503: true}},
+		{"empty string", "", map[int]bool{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := parseRetryStatusCodes(tc.s)
+			if len(got) != len(tc.want) {
+				t.Fatalf("parseRetryStatusCodes(%q) = %v, want %v", tc.s, got, tc.want)
+			}
+			for code := range tc.want {
+				if !got[code] {
+					t.Errorf("parseRetryStatusCodes(%q) missing code %d", tc.s, code)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	codes := map[int]bool{500: true, 503: true}
+	policy := retryPolicy(2, codes)
+
+	get := &http.Request{Method: http.MethodGet}
+	put := &http.Request{Method: http.MethodPut}
+
+	tests := []struct {
+		name    string
+		attempt rehttp.Attempt
+		want    bool
+	}{
+		{
+			name:    "idempotent method with retryable status",
+			attempt: rehttp.Attempt{Index: 0, Request: get, Response: &http.Response{StatusCode: 500}},
+			want:    true,
+		},
+		{
+			name:    "idempotent method with non-retryable status",
+			attempt: rehttp.Attempt{Index: 0, Request: get, Response: &http.Response{StatusCode: 404}},
+			want:    false,
+		},
+		{
+			name:    "non-idempotent method is never retried, even with a retryable status",
+			attempt: rehttp.Attempt{Index: 0, Request: put, Response: &http.Response{StatusCode: 500}},
+			want:    false,
+		},
+		{
+			name:    "idempotent method with a transport error and no response",
+			attempt: rehttp.Attempt{Index: 0, Request: get, Error: errors.New("connection reset")},
+			want:    true,
+		},
+		{
+			name:    "no response and no error",
+			attempt: rehttp.Attempt{Index: 0, Request: get},
+			want:    false,
+		},
+		{
+			name:    "attempt index at maxRetries is not retried",
+			attempt: rehttp.Attempt{Index: 2, Request: get, Response: &http.Response{StatusCode: 500}},
+			want:    false,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := policy(tc.attempt); got != tc.want {
+				t.Errorf("policy(%+v) = %v, want %v", tc.attempt, got, tc.want)
+			}
+		})
+	}
+}
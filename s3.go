@@ -1,22 +1,84 @@
 package main
 
 import (
-	"log"
+	"flag"
+	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/defaults"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
+var (
+	s3AccessKeyID      = flag.String("s3-access-key-id", "", "static AWS access key id (takes priority over the shared config file and instance role)")
+	s3SecretAccessKey  = flag.String("s3-secret-access-key", "", "static AWS secret access key, used together with -s3-access-key-id")
+	s3SharedConfigFile = flag.String("s3-shared-config-file", "", "path to a shared AWS config/credentials file, tried after static keys and AWS_* environment variables (default: the SDK's usual ~/.aws/credentials)")
+	s3Profile          = flag.String("s3-profile", "", "profile name to use from -s3-shared-config-file")
+)
+
+// s3CredentialChain builds the explicit credential-provider chain tried in
+// order: static keys from flags, AWS_* environment variables, a shared
+// config file, then the EC2/ECS instance role via the metadata service.
+// This mirrors the SDK's own default chain but makes the order and the
+// flag-controlled pieces explicit rather than relying on session.New()'s
+// implicit behavior.
+func s3CredentialChain(sess *session.Session) *credentials.Credentials {
+	var providers []credentials.Provider
+
+	if *s3AccessKeyID != "" && *s3SecretAccessKey != "" {
+		providers = append(providers, &credentials.StaticProvider{Value: credentials.Value{
+			AccessKeyID:     *s3AccessKeyID,
+			SecretAccessKey: *s3SecretAccessKey,
+		}})
+	}
+
+	providers = append(providers, &credentials.EnvProvider{})
+
+	providers = append(providers, &credentials.SharedCredentialsProvider{
+		Filename: *s3SharedConfigFile,
+		Profile:  *s3Profile,
+	})
+
+	// defaults.RemoteCredProvider picks between the ECS task role
+	// (when AWS_CONTAINER_CREDENTIALS_RELATIVE_URI is set) and the EC2
+	// instance role via the metadata service.
+	providers = append(providers, defaults.RemoteCredProvider(*sess.Config, sess.Handlers))
+
+	return credentials.NewChainCredentials(providers)
+}
+
+// s3ObjectOptions controls how objects are written to S3: the storage
+// tier they land in and, optionally, server-side encryption.
+type s3ObjectOptions struct {
+	StorageClass         string
+	ServerSideEncryption string
+	SSEKMSKeyID          string
+}
+
+func (o s3ObjectOptions) apply(input *s3.PutObjectInput) {
+	if o.StorageClass != "" {
+		input.StorageClass = aws.String(o.StorageClass)
+	}
+	if o.ServerSideEncryption != "" {
+		input.ServerSideEncryption = aws.String(o.ServerSideEncryption)
+	}
+	if o.SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(o.SSEKMSKeyID)
+	}
+}
+
 type s3Director struct {
-	s3Svc  *s3.S3
-	bucket string
-	prefix string
+	s3Svc   *s3.S3
+	bucket  string
+	prefix  string
+	objOpts s3ObjectOptions
 }
 
 func effectiveKey(prefix, userPath string) string {
@@ -33,10 +95,11 @@ func effectiveKey(prefix, userPath string) string {
 	return prefix + "/" + userPath
 }
 
-func (s *s3Director) Direct(r *http.Request) {
+func (s *s3Director) Direct(r *http.Request) error {
 
 	key := effectiveKey(s.prefix, r.URL.Path)
 
+	op := r.Method
 	var s3Req *request.Request
 	switch r.Method {
 	case http.MethodGet:
@@ -45,32 +108,80 @@ func (s *s3Director) Direct(r *http.Request) {
 			Key:    aws.String(key),
 		})
 	case http.MethodPut:
-		s3Req, _ = s.s3Svc.PutObjectRequest(&s3.PutObjectInput{
+		input := &s3.PutObjectInput{
 			Bucket: &s.bucket,
 			Key:    aws.String(key),
-		})
+		}
+		s.objOpts.apply(input)
+		s3Req, _ = s.s3Svc.PutObjectRequest(input)
 	default:
-		log.Fatal("Unsupported method: %s", r.Method)
+		return fmt.Errorf("unsupported method: %s", r.Method)
 	}
 
 	purl, err := s3Req.Presign(10 * time.Minute)
 	if err != nil {
-		log.Fatal("Presign failed (%v) for request %+v", err, s3Req)
+		backendOperationsTotal.WithLabelValues("s3", op, "error").Inc()
+		return fmt.Errorf("presigning request for key %q: %w", key, err)
 	}
+	backendOperationsTotal.WithLabelValues("s3", op, "ok").Inc()
 
 	r.URL, _ = url.Parse(purl)
 	r.Host = ""
+	return nil
 }
 
-func newS3Director(session *session.Session, url *url.URL) *s3Director {
-	s3Svc := s3.New(session)
+// s3DirectorConfig carries the flag-controlled parts of the S3 backend
+// setup: an optional non-AWS endpoint (MinIO, GCS's S3 gateway, ...),
+// an optional region override, and the object-write options to apply to
+// every PUT.
+type s3DirectorConfig struct {
+	Endpoint    string
+	Region      string
+	ObjOpts     s3ObjectOptions
+	Credentials *credentials.Credentials
+}
 
-	bucket := url.Host
-	prefix := strings.Trim(url.Path, "/")
+func newS3Director(sess *session.Session, backendURL *url.URL, cfg s3DirectorConfig) *s3Director {
+	awsCfg := aws.NewConfig()
+	if cfg.Region != "" {
+		awsCfg = awsCfg.WithRegion(cfg.Region)
+	}
+	if cfg.Credentials != nil {
+		awsCfg = awsCfg.WithCredentials(cfg.Credentials)
+	}
+	if cfg.Endpoint != "" {
+		// Non-AWS S3-compatible endpoints (MinIO, GCS's S3
+		// interoperability gateway, ...) require path-style bucket
+		// addressing since they don't support bucket subdomains.
+		awsCfg = awsCfg.WithEndpoint(cfg.Endpoint).WithS3ForcePathStyle(true)
+	}
+
+	s3Svc := s3.New(sess, awsCfg)
+
+	bucket := backendURL.Host
+	prefix := strings.Trim(backendURL.Path, "/")
 
 	return &s3Director{
-		s3Svc:  s3Svc,
-		bucket: bucket,
-		prefix: prefix,
+		s3Svc:   s3Svc,
+		bucket:  bucket,
+		prefix:  prefix,
+		objOpts: cfg.ObjOpts,
 	}
 }
+
+func init() {
+	registerDirector("s3", func(backendURL *url.URL) (BackendDirector, http.RoundTripper, error) {
+		sess := session.New()
+		d := newS3Director(sess, backendURL, s3DirectorConfig{
+			Endpoint: *s3Endpoint,
+			Region:   *s3Region,
+			ObjOpts: s3ObjectOptions{
+				StorageClass:         *s3StorageClass,
+				ServerSideEncryption: *s3SSE,
+				SSEKMSKeyID:          *s3SSEKMSKeyID,
+			},
+			Credentials: s3CredentialChain(sess),
+		})
+		return d, nil, nil
+	})
+}